@@ -0,0 +1,263 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipset
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Backend is implemented by anything that can carry out the primitive
+// ipset operations. IPSet dispatches every call through a Backend so
+// that the CLI-based implementation and the netlink-based one are
+// interchangeable.
+type Backend interface {
+	Create(name, hashType string, p *Params) error
+	Destroy(name string) error
+	Add(name string, entry Entry, timeout int) error
+	Del(name string, entry Entry) error
+	Test(name string, entry Entry) (bool, error)
+	List(name string) ([]string, error)
+	Swap(from, to string) error
+	Flush(name string) error
+
+	// Refresh hot-swaps s with a temporary set populated with entries.
+	Refresh(s *IPSet, entries []Entry) error
+}
+
+// cliBackend talks to the kernel by shelling out to the ipset binary
+// via h. It is the original implementation and remains the fallback
+// when the netlink backend cannot be used.
+type cliBackend struct {
+	h *Handle
+}
+
+// defaultCLI returns a cliBackend bound to the package-wide
+// DefaultHandle, backing the package-level functions (Add, Del, Test,
+// ...).
+func defaultCLI() cliBackend {
+	return cliBackend{h: DefaultHandle()}
+}
+
+// run resolves the ipset binary via h and returns the combined
+// stdout/stderr of running it with args.
+func (h *Handle) run(args ...string) ([]byte, error) {
+	cmd, err := h.command(args...)
+	if err != nil {
+		return nil, err
+	}
+	return cmd.CombinedOutput()
+}
+
+func (b cliBackend) Create(name, hashType string, p *Params) error {
+	args := []string{"create", name, hashType}
+	switch SetType(hashType) {
+	case BitmapIP, BitmapPort, BitmapIPMAC:
+		args = append(args, "range", p.Range)
+	case ListSet:
+		args = append(args, "size", strconv.Itoa(p.Size))
+	default:
+		args = append(args, "family", p.HashFamily, "hashsize", strconv.Itoa(p.HashSize), "maxelem", strconv.Itoa(p.MaxElem))
+	}
+	args = append(args, "timeout", strconv.Itoa(p.Timeout))
+	if p.Exist {
+		args = append(args, "-exist")
+	}
+	out, err := b.h.run(args...)
+	if err != nil {
+		return fmt.Errorf("error creating ipset %s with type %s: %v (%s)", name, hashType, err, out)
+	}
+	return b.Flush(name)
+}
+
+func (b cliBackend) Destroy(name string) error {
+	out, err := b.h.run("destroy", name)
+	if err != nil {
+		return fmt.Errorf("error destroying set %s: %v (%s)", name, err, out)
+	}
+	return nil
+}
+
+func (b cliBackend) Add(name string, entry Entry, timeout int) error {
+	args := append([]string{"add", name}, entry.ipsetArgs()...)
+	args = append(args, "timeout", strconv.Itoa(timeout), "-exist")
+	out, err := b.h.run(args...)
+	if err != nil {
+		return fmt.Errorf("error adding entry %v: %v (%s)", entry.ipsetArgs(), err, out)
+	}
+	return nil
+}
+
+func (b cliBackend) Del(name string, entry Entry) error {
+	args := append([]string{"del", name}, entry.ipsetArgs()...)
+	args = append(args, "-exist")
+	out, err := b.h.run(args...)
+	if err != nil {
+		return fmt.Errorf("error deleting entry %v: %v (%s)", entry.ipsetArgs(), err, out)
+	}
+	return nil
+}
+
+func (b cliBackend) Test(name string, entry Entry) (bool, error) {
+	args := append([]string{"test", name}, entry.ipsetArgs()...)
+	out, err := b.h.run(args...)
+	if err != nil {
+		return false, fmt.Errorf("error testing entry %v: %v (%s)", entry.ipsetArgs(), err, out)
+	}
+	if regexp.MustCompile("NOT").MatchString(string(out)) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (b cliBackend) List(name string) ([]string, error) {
+	out, err := b.h.run("list", name)
+	if err != nil {
+		return []string{}, fmt.Errorf("error listing set %s: %v (%s)", name, err, out)
+	}
+	r := regexp.MustCompile("(?m)^(.*\n)*Members:\n")
+	list := r.ReplaceAllString(string(out[:]), "")
+	return strings.Split(list, "\n"), nil
+}
+
+func (b cliBackend) Swap(from, to string) error {
+	out, err := b.h.run("swap", from, to)
+	if err != nil {
+		return fmt.Errorf("error swapping ipset %s to %s: %v (%s)", from, to, err, out)
+	}
+	return nil
+}
+
+func (b cliBackend) Flush(name string) error {
+	out, err := b.h.run("flush", name)
+	if err != nil {
+		return fmt.Errorf("error flushing ipset %s: %v (%s)", name, err, out)
+	}
+	return nil
+}
+
+// Refresh builds a single ipset-restore script that creates a temporary
+// set, populates it, swaps it in for name and destroys the temporary
+// set, then feeds the whole thing to one "ipset restore" process. This
+// replaces the historical approach of forking "ipset add" once per
+// entry, which dominated runtime on large sets.
+func (b cliBackend) Refresh(s *IPSet, entries []Entry) error {
+	tempName := s.Name + "-temp"
+	var script restoreScript
+	script.create(tempName, s.HashType, &Params{
+		HashFamily: s.HashFamily,
+		HashSize:   s.HashSize,
+		MaxElem:    s.MaxElem,
+		Timeout:    s.Timeout,
+		Range:      s.Range,
+		Size:       s.Size,
+		Exist:      true,
+	})
+	script.flush(tempName)
+	for _, entry := range entries {
+		script.add(tempName, entry, 0)
+	}
+	script.swap(tempName, s.Name)
+	script.destroy(tempName)
+	return b.h.runRestore(script.Bytes())
+}
+
+// fallbackBackend prefers the netlink backend but retries a call
+// through the CLI backend whenever netlink reports errUnsupported,
+// i.e. the set type or entry kind isn't one it can encode yet
+// (bitmap:*/list:set, or anything but a bare IP entry). Without this,
+// a netlink-capable host would make those operations fail outright
+// the moment the handshake in newNetlinkBackend succeeds, instead of
+// simply falling back like a netlink-incapable host does.
+type fallbackBackend struct {
+	netlink *netlinkBackend
+	cli     cliBackend
+}
+
+func (b fallbackBackend) Create(name, hashType string, p *Params) error {
+	if err := b.netlink.Create(name, hashType, p); !errors.Is(err, errUnsupported) {
+		return err
+	}
+	return b.cli.Create(name, hashType, p)
+}
+
+func (b fallbackBackend) Destroy(name string) error {
+	return b.netlink.Destroy(name)
+}
+
+func (b fallbackBackend) Add(name string, entry Entry, timeout int) error {
+	if err := b.netlink.Add(name, entry, timeout); !errors.Is(err, errUnsupported) {
+		return err
+	}
+	return b.cli.Add(name, entry, timeout)
+}
+
+func (b fallbackBackend) Del(name string, entry Entry) error {
+	if err := b.netlink.Del(name, entry); !errors.Is(err, errUnsupported) {
+		return err
+	}
+	return b.cli.Del(name, entry)
+}
+
+func (b fallbackBackend) Test(name string, entry Entry) (bool, error) {
+	ok, err := b.netlink.Test(name, entry)
+	if !errors.Is(err, errUnsupported) {
+		return ok, err
+	}
+	return b.cli.Test(name, entry)
+}
+
+func (b fallbackBackend) List(name string) ([]string, error) {
+	return b.netlink.List(name)
+}
+
+func (b fallbackBackend) Swap(from, to string) error {
+	return b.netlink.Swap(from, to)
+}
+
+func (b fallbackBackend) Flush(name string) error {
+	return b.netlink.Flush(name)
+}
+
+// Refresh tries the netlink batch path; nothing is sent to the kernel
+// until every message in the batch has been built, so falling back to
+// the CLI backend on errUnsupported (e.g. one of entries isn't a bare
+// IP) is safe even partway through building that batch.
+func (b fallbackBackend) Refresh(s *IPSet, entries []Entry) error {
+	if err := b.netlink.Refresh(s, entries); !errors.Is(err, errUnsupported) {
+		return err
+	}
+	return b.cli.Refresh(s, entries)
+}
+
+// backendForHandle picks the fastest Backend available for h: netlink,
+// falling back to the CLI backend bound to h per operation where
+// netlink can't handle the set type or entry kind involved, if the
+// kernel's ipset netlink subsystem answers at all; otherwise the CLI
+// backend alone.
+func backendForHandle(h *Handle) Backend {
+	if nb, err := newNetlinkBackend(); err == nil {
+		log.Debug("using netlink backend for ipset, with per-operation CLI fallback")
+		return fallbackBackend{netlink: nb, cli: cliBackend{h: h}}
+	}
+	return cliBackend{h: h}
+}
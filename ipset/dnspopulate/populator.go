@@ -0,0 +1,152 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dnspopulate auto-populates ipsets from DNS answers, the way
+// dnsmasq's "--ipset=" option feeds a domain's resolved addresses into
+// named sets. Callers wire it into their own DNS proxy or resolver by
+// calling Observe for every answer seen.
+package dnspopulate
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/janeczku/go-ipset/ipset"
+)
+
+// MatchMode controls how a qname matching more than one registered
+// domain suffix is handled.
+type MatchMode int
+
+const (
+	// LongestSuffixMatch feeds only the most specific matching rule,
+	// e.g. "foo.example.com" prefers a "foo.example.com" rule over an
+	// "example.com" one if both are registered.
+	LongestSuffixMatch MatchMode = iota
+	// MatchAll feeds every rule whose domain suffix matches, e.g. an
+	// answer for "foo.example.com" reaches both an "example.com" rule
+	// and a "foo.example.com" rule.
+	MatchAll
+)
+
+type rule struct {
+	suffix string
+	sets   []*ipset.IPSet
+}
+
+// node is one label of the reversed-domain trie described at
+// reversedLabels.
+type node struct {
+	children map[string]*node
+	rule     *rule
+}
+
+// Populator watches DNS answers and adds resolved addresses to the
+// ipsets registered for the queried domain, matching dnsmasq's
+// "--ipset=/example.com/set-name" semantics: a rule for "example.com"
+// also matches "foo.example.com".
+type Populator struct {
+	mu   sync.RWMutex
+	root *node
+	mode MatchMode
+}
+
+// New creates a Populator with no rules. mode decides what happens when
+// a qname matches more than one registered suffix.
+func New(mode MatchMode) *Populator {
+	return &Populator{root: &node{children: map[string]*node{}}, mode: mode}
+}
+
+// reversedLabels splits a domain name into its labels, reversed so the
+// TLD comes first ("foo.example.com" -> ["com", "example", "foo"]).
+// Reversing lets AddRule/Observe share a simple trie walk: any domain
+// under "example.com" shares that path's first two nodes.
+func reversedLabels(domain string) []string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// AddRule registers sets to receive addresses resolved for
+// domainSuffix, and for any subdomain of it.
+func (p *Populator) AddRule(domainSuffix string, sets ...*ipset.IPSet) {
+	labels := reversedLabels(domainSuffix)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.root
+	for _, label := range labels {
+		child, ok := n.children[label]
+		if !ok {
+			child = &node{children: map[string]*node{}}
+			n.children[label] = child
+		}
+		n = child
+	}
+	n.rule = &rule{suffix: domainSuffix, sets: sets}
+}
+
+// matchingRules walks the trie along labels, collecting the rules that
+// match per p.mode.
+func (p *Populator) matchingRules(labels []string) []*rule {
+	var all []*rule
+	var longest *rule
+	n := p.root
+	for _, label := range labels {
+		child, ok := n.children[label]
+		if !ok {
+			break
+		}
+		n = child
+		if n.rule != nil {
+			longest = n.rule
+			all = append(all, n.rule)
+		}
+	}
+	if p.mode == LongestSuffixMatch {
+		if longest == nil {
+			return nil
+		}
+		return []*rule{longest}
+	}
+	return all
+}
+
+// Observe feeds one resolved DNS answer to the populator. qname is the
+// name that was queried; answers are its resolved addresses; ttl is the
+// TTL (in seconds) of the DNS answer, used as the ipset entry timeout so
+// entries age out the same time the DNS record itself would.
+func (p *Populator) Observe(qname string, answers []netip.Addr, ttl int) error {
+	labels := reversedLabels(qname)
+	p.mu.RLock()
+	rules := p.matchingRules(labels)
+	p.mu.RUnlock()
+
+	for _, r := range rules {
+		for _, addr := range answers {
+			entry := ipset.EntryIP(net.IP(addr.AsSlice()))
+			for _, s := range r.sets {
+				if err := s.Add(entry, ttl); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipset
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// DualStackSet pairs an IPv4 and an IPv6 set under a common name, so
+// callers no longer have to create "family inet"/"family inet6" sets by
+// hand and dispatch to the right one based on net.IP.To4(). The
+// underlying sets are named "<prefix>-v4" and "<prefix>-v6".
+type DualStackSet struct {
+	Prefix string
+	V4     *IPSet
+	V6     *IPSet
+}
+
+// NewDualStackSet creates the v4 and v6 sets backing a DualStackSet.
+// p.HashFamily is overridden per underlying set ("inet" / "inet6").
+func NewDualStackSet(prefix, hashtype string, p *Params) (*DualStackSet, error) {
+	v4Params := *p
+	v4Params.HashFamily = "inet"
+	v4, err := New(prefix+"-v4", hashtype, &v4Params)
+	if err != nil {
+		return nil, err
+	}
+
+	v6Params := *p
+	v6Params.HashFamily = "inet6"
+	v6, err := New(prefix+"-v6", hashtype, &v6Params)
+	if err != nil {
+		v4.Destroy()
+		return nil, err
+	}
+
+	return &DualStackSet{Prefix: prefix, V4: v4, V6: v6}, nil
+}
+
+// parseEntryAddr extracts the address family of entry, which may be a
+// bare IP ("2001:db8::1") or a CIDR ("10.0.0.0/8").
+func parseEntryAddr(entry string) (netip.Addr, error) {
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		return prefix.Addr(), nil
+	}
+	return netip.ParseAddr(entry)
+}
+
+func (d *DualStackSet) pick(addr netip.Addr) *IPSet {
+	if addr.Is4() || addr.Is4In6() {
+		return d.V4
+	}
+	return d.V6
+}
+
+// Add adds entry to whichever of V4/V6 matches its address family.
+func (d *DualStackSet) Add(entry string, timeout int) error {
+	addr, err := parseEntryAddr(entry)
+	if err != nil {
+		return fmt.Errorf("dualstack: invalid address %q: %v", entry, err)
+	}
+	return d.pick(addr).Add(RawEntry(entry), timeout)
+}
+
+// Del removes entry from whichever of V4/V6 matches its address family.
+func (d *DualStackSet) Del(entry string) error {
+	addr, err := parseEntryAddr(entry)
+	if err != nil {
+		return fmt.Errorf("dualstack: invalid address %q: %v", entry, err)
+	}
+	return d.pick(addr).Del(RawEntry(entry))
+}
+
+// Test checks whether entry is a member of whichever of V4/V6 matches
+// its address family.
+func (d *DualStackSet) Test(entry string) (bool, error) {
+	addr, err := parseEntryAddr(entry)
+	if err != nil {
+		return false, fmt.Errorf("dualstack: invalid address %q: %v", entry, err)
+	}
+	return d.pick(addr).Test(RawEntry(entry))
+}
+
+// Refresh partitions entries by address family and hot-swaps V4 and V6
+// independently, so each family's swap stays atomic.
+func (d *DualStackSet) Refresh(entries []string) error {
+	var v4, v6 []string
+	for _, entry := range entries {
+		addr, err := parseEntryAddr(entry)
+		if err != nil {
+			return fmt.Errorf("dualstack: invalid address %q: %v", entry, err)
+		}
+		if addr.Is4() || addr.Is4In6() {
+			v4 = append(v4, entry)
+		} else {
+			v6 = append(v6, entry)
+		}
+	}
+	if err := d.V4.Refresh(v4); err != nil {
+		return err
+	}
+	return d.V6.Refresh(v6)
+}
+
+// List returns the merged members of V4 and V6.
+func (d *DualStackSet) List() ([]string, error) {
+	v4List, err := d.V4.List()
+	if err != nil {
+		return nil, err
+	}
+	v6List, err := d.V6.List()
+	if err != nil {
+		return nil, err
+	}
+	return append(v4List, v6List...), nil
+}
+
+// Destroy destroys both underlying sets.
+func (d *DualStackSet) Destroy() error {
+	if err := d.V4.Destroy(); err != nil {
+		return err
+	}
+	return d.V6.Destroy()
+}
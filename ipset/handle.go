@@ -0,0 +1,207 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipset
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-semver/semver"
+	utilexec "k8s.io/utils/exec"
+)
+
+// Handle carries everything needed to shell out to ipset: the
+// exec.Interface to use (real or fake, for tests), the binary path
+// (looked up lazily unless set explicitly) and a cached, lazily
+// evaluated version check. Unlike the package's original init(), a
+// Handle never panics; callers see an error the first time they
+// actually need ipset.
+type Handle struct {
+	Path string
+	Exec utilexec.Interface
+
+	mu       sync.Mutex
+	resolved string
+	checkErr error
+	checked  bool
+
+	resyncOverride *bool
+	resyncChecked  bool
+	resyncOnDelete bool
+}
+
+// HandleOption configures a Handle at construction time.
+type HandleOption func(*Handle)
+
+// WithResyncOnDelete forces the resync-on-delete workaround (see
+// IPSet.Del) on or off, overriding the kernel-version auto-detection.
+// Use it to force it off on a kernel known to carry the fix despite
+// reporting a 4.2-4.10 release, or to force it on for kernels that
+// backport the bug under a different version number.
+func WithResyncOnDelete(enabled bool) HandleOption {
+	return func(h *Handle) { h.resyncOverride = &enabled }
+}
+
+// NewHandle returns a Handle that looks up ipset via execIface instead
+// of the default os/exec-backed implementation. path may be empty to
+// fall back to looking ipset up on $PATH.
+func NewHandle(path string, execIface utilexec.Interface, opts ...HandleOption) *Handle {
+	h := &Handle{Path: path, Exec: execIface}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+var (
+	defaultHandle     *Handle
+	defaultHandleOnce sync.Once
+)
+
+// DefaultHandle returns the package-wide Handle used by the
+// package-level functions (Add, Del, Test, ...), creating it on first
+// use with the real OS exec implementation.
+func DefaultHandle() *Handle {
+	defaultHandleOnce.Do(func() {
+		defaultHandle = NewHandle("", utilexec.New())
+	})
+	return defaultHandle
+}
+
+// binPath resolves the ipset binary path, looking it up via Exec.LookPath
+// on first use if Path wasn't set explicitly.
+func (h *Handle) binPath() (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.binPathLocked()
+}
+
+// binPathLocked is binPath's body, for callers that already hold h.mu.
+func (h *Handle) binPathLocked() (string, error) {
+	if h.Path != "" {
+		return h.Path, nil
+	}
+	if h.resolved != "" {
+		return h.resolved, nil
+	}
+	path, err := h.Exec.LookPath("ipset")
+	if err != nil {
+		return "", errIpsetNotFound
+	}
+	h.resolved = path
+	return path, nil
+}
+
+// CheckVersion verifies the ipset binary is present and at least
+// version 6.0, caching the result. It replaces the historical init()
+// panic: callers now get an error instead of a crash, and packages that
+// never call ipset (or run under a fake Exec in tests) never pay for
+// the check.
+func (h *Handle) CheckVersion() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checked {
+		return h.checkErr
+	}
+	h.checked = true
+	h.checkErr = h.checkVersionLocked()
+	return h.checkErr
+}
+
+func (h *Handle) checkVersionLocked() error {
+	path, err := h.binPathLocked()
+	if err != nil {
+		return err
+	}
+	out, err := h.Exec.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error checking ipset version: %v (%s)", err, out)
+	}
+	versionMatcher := regexp.MustCompile(`v[0-9]+\.[0-9]+`)
+	match := versionMatcher.FindStringSubmatch(string(out))
+	if match == nil {
+		return fmt.Errorf("no ipset version found in string: %s", out)
+	}
+	version, err := semver.NewVersion(match[0][1:] + ".0")
+	if err != nil {
+		return err
+	}
+	minVersion, err := semver.NewVersion(minIpsetVersion)
+	if err != nil {
+		return err
+	}
+	if version.LessThan(*minVersion) {
+		return errIpsetNotSupported
+	}
+	return nil
+}
+
+// command resolves the ipset binary and builds a Cmd for it via Exec,
+// so tests can substitute a FakeExec that records invocations instead
+// of spawning a real process.
+func (h *Handle) command(args ...string) (utilexec.Cmd, error) {
+	path, err := h.binPath()
+	if err != nil {
+		return nil, err
+	}
+	return h.Exec.Command(path, args...), nil
+}
+
+var kernelReleaseMatcher = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// kernelNeedsResyncOnDelete reports whether release is a Linux 4.2-4.10
+// kernel, the range affected by a kernel bug where deleting one member
+// of an ipset can silently drop unrelated members. It fails open
+// (false) on anything it can't parse.
+func kernelNeedsResyncOnDelete(release string) bool {
+	match := kernelReleaseMatcher.FindStringSubmatch(release)
+	if match == nil {
+		return false
+	}
+	major, err := strconv.Atoi(match[1])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(match[2])
+	if err != nil {
+		return false
+	}
+	return major == 4 && minor >= 2 && minor <= 10
+}
+
+// resyncOnDeleteEnabled reports whether h's IPSets should work around
+// the 4.2-4.10 ipset corruption bug (see IPSet.Del). The kernel release
+// is checked via "uname -r" through h.Exec, the same injection point
+// used for ipset itself, and the result is cached like CheckVersion's.
+// WithResyncOnDelete overrides the detection outright.
+func (h *Handle) resyncOnDeleteEnabled() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.resyncOverride != nil {
+		return *h.resyncOverride
+	}
+	if !h.resyncChecked {
+		h.resyncChecked = true
+		if out, err := h.Exec.Command("uname", "-r").CombinedOutput(); err == nil {
+			h.resyncOnDelete = kernelNeedsResyncOnDelete(strings.TrimSpace(string(out)))
+		}
+	}
+	return h.resyncOnDelete
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipset
+
+import (
+	"reflect"
+	"testing"
+
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+// TestHandleAddUsesInjectedExec exercises cliBackend.Add through a
+// FakeExec, proving the package no longer needs a real ipset binary
+// (or even a Linux kernel) to be unit-tested.
+func TestHandleAddUsesInjectedExec(t *testing.T) {
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(""), nil },
+		},
+	}
+	fexec := &fakeexec.FakeExec{
+		LookPathFunc: func(string) (string, error) { return "/usr/sbin/ipset", nil },
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd {
+				return fakeexec.InitFakeCmd(&fcmd, cmd, args...)
+			},
+		},
+	}
+	h := NewHandle("", fexec)
+	backend := cliBackend{h: h}
+
+	if err := backend.Add("blocklist", RawEntry("10.0.0.1"), 0); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if fcmd.CombinedOutputCalls != 1 {
+		t.Fatalf("expected 1 invocation, got %d", fcmd.CombinedOutputCalls)
+	}
+	want := []string{"/usr/sbin/ipset", "add", "blocklist", "10.0.0.1", "timeout", "0", "-exist"}
+	if got := fcmd.CombinedOutputLog[0]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got args %v, want %v", got, want)
+	}
+}
+
+// TestHandleCheckVersionIsLazyAndCached verifies CheckVersion only
+// shells out once per Handle, and never on construction.
+func TestHandleCheckVersionIsLazyAndCached(t *testing.T) {
+	calls := 0
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { calls++; return []byte("ipset v6.38"), nil },
+		},
+	}
+	fexec := &fakeexec.FakeExec{
+		LookPathFunc: func(string) (string, error) { return "/usr/sbin/ipset", nil },
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd {
+				return fakeexec.InitFakeCmd(&fcmd, cmd, args...)
+			},
+		},
+	}
+	h := NewHandle("", fexec)
+	if calls != 0 {
+		t.Fatalf("constructing a Handle must not shell out, got %d calls", calls)
+	}
+	if err := h.CheckVersion(); err != nil {
+		t.Fatalf("CheckVersion: %v", err)
+	}
+	if err := h.CheckVersion(); err != nil {
+		t.Fatalf("CheckVersion (cached): %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the version check to run once and be cached, got %d calls", calls)
+	}
+}
+
+func TestKernelNeedsResyncOnDelete(t *testing.T) {
+	cases := map[string]bool{
+		"4.4.0-21-generic": true,
+		"4.2.0":            true,
+		"4.10.17-300.fc26": true,
+		"4.11.0":           false,
+		"4.1.0":            false,
+		"5.15.0-generic":   false,
+		"not-a-version":    false,
+	}
+	for release, want := range cases {
+		if got := kernelNeedsResyncOnDelete(release); got != want {
+			t.Errorf("kernelNeedsResyncOnDelete(%q) = %v, want %v", release, got, want)
+		}
+	}
+}
+
+// TestHandleResyncOnDeleteDetectsOnce verifies the "uname -r" check only
+// runs once per Handle and that WithResyncOnDelete skips it entirely.
+func TestHandleResyncOnDeleteDetectsOnce(t *testing.T) {
+	calls := 0
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { calls++; return []byte("4.4.0-21-generic\n"), nil },
+		},
+	}
+	fexec := &fakeexec.FakeExec{
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd {
+				return fakeexec.InitFakeCmd(&fcmd, cmd, args...)
+			},
+		},
+	}
+	h := NewHandle("", fexec)
+	if !h.resyncOnDeleteEnabled() {
+		t.Fatalf("expected resync-on-delete to be detected for a 4.4 kernel")
+	}
+	if !h.resyncOnDeleteEnabled() {
+		t.Fatalf("expected cached result to stay true")
+	}
+	if calls != 1 {
+		t.Fatalf("expected uname to run once, got %d calls", calls)
+	}
+
+	forced := NewHandle("", fexec, WithResyncOnDelete(false))
+	if forced.resyncOnDeleteEnabled() {
+		t.Fatalf("WithResyncOnDelete(false) should override detection")
+	}
+}
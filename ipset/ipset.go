@@ -20,19 +20,13 @@ package ipset
 import (
 	"errors"
 	"fmt"
-	"os/exec"
-	"regexp"
-	"strconv"
 	"strings"
-
-	log "github.com/Sirupsen/logrus"
-	"github.com/coreos/go-semver/semver"
+	"sync"
 )
 
 const minIpsetVersion = "6.0.0"
 
 var (
-	ipsetPath            string
 	errIpsetNotFound     = errors.New("Ipset utility not found")
 	errIpsetNotSupported = errors.New("Ipset utility version is not supported, requiring version >= 6.0")
 )
@@ -44,6 +38,14 @@ type Params struct {
 	MaxElem    int
 	Timeout    int
 	Exist      bool
+
+	// Range is required by the bitmap:* set types, e.g. "192.168.0.0/16"
+	// or "0-65535".
+	Range string
+
+	// Size is the maximum number of members a list:set may hold. It is
+	// that type's equivalent of MaxElem and defaults to 8.
+	Size int
 }
 
 // IPSet implements an Interface to an set.
@@ -54,73 +56,78 @@ type IPSet struct {
 	HashSize   int
 	MaxElem    int
 	Timeout    int
+	Range      string
+	Size       int
+
+	backend Backend
+
+	// expected tracks, by entryValue, every entry Add has handed to the
+	// backend, along with the timeout it was added with. Del's resync
+	// workaround (see Del) uses it to notice members the kernel
+	// silently dropped, and to re-add them with their original timeout
+	// rather than as permanent entries. It costs one map write per Add
+	// and is kept on all kernels so the bug can be detected even if a
+	// Handle's resync check hasn't run yet.
+	expectedMu sync.Mutex
+	expected   map[string]expectedEntry
 }
 
-func init() {
-	path, err := exec.LookPath("ipset")
-	if err != nil {
-		panic(errIpsetNotFound)
-	}
-	ipsetPath = path
-	supportedVersion, err := getIpsetSupportedVersion()
-	if err != nil {
-		log.Warnf("Error checking ipset version, assuming version at least 6.0.0: %v", err)
-		supportedVersion = true
-	}
-	if supportedVersion {
-		return
-	}
-	panic(errIpsetNotSupported)
+// expectedEntry pairs an Add-ed Entry with the timeout it was added
+// with, so resyncAfterDelete can restore both exactly as they were.
+type expectedEntry struct {
+	entry   Entry
+	timeout int
 }
 
 func (s *IPSet) createHashSet(name string, exist bool) error {
-	/*	out, err := exec.Command("/usr/bin/sudo",
-		ipsetPath, "create", name, s.HashType, "family", s.HashFamily, "hashsize", strconv.Itoa(s.HashSize),
-		"maxelem", strconv.Itoa(s.MaxElem), "timeout", strconv.Itoa(s.Timeout), "-exist").CombinedOutput()*/
-
-	cmd := []string{
-		ipsetPath, "create", name, s.HashType, "family", s.HashFamily, "hashsize", strconv.Itoa(s.HashSize),
-		"maxelem", strconv.Itoa(s.MaxElem), "timeout", strconv.Itoa(s.Timeout),
-	}
-
-	if exist {
-		cmd = append(cmd, "-exist")
-	}
-
-	out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error creating ipset %s with type %s: %v (%s)", name, s.HashType, err, out)
-	}
-	out, err = exec.Command(ipsetPath, "flush", name).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error flushing ipset %s: %v (%s)", name, err, out)
-	}
-	return nil
+	return s.backend.Create(name, s.HashType, &Params{
+		HashFamily: s.HashFamily,
+		HashSize:   s.HashSize,
+		MaxElem:    s.MaxElem,
+		Timeout:    s.Timeout,
+		Range:      s.Range,
+		Size:       s.Size,
+		Exist:      exist,
+	})
 }
 
-// New creates a new set and returns an Interface to it.
+// New creates a new set and returns an Interface to it. hashtype is one
+// of the SetType constants (hash:ip, bitmap:ip, list:set, ...); Params
+// must carry whatever that type requires (e.g. Range for bitmap:*,
+// Size for list:set). It uses DefaultHandle() to decide which Backend
+// to talk through; use NewWithHandle to control that explicitly, e.g.
+// in tests.
 // Example:
-// 	testIpset := ipset.New("test", "hash:ip", &ipset.Params{})
+// 	testIpset := ipset.New("test", string(ipset.HashIP), &ipset.Params{})
 func New(name string, hashtype string, p *Params) (*IPSet, error) {
-	// Using the ipset utilities default values here
-	if p.HashSize == 0 {
-		p.HashSize = 1024
-	}
+	return NewWithHandle(DefaultHandle(), name, hashtype, p)
+}
 
-	if p.MaxElem == 0 {
-		p.MaxElem = 65536
+// NewWithHandle is New, but talks through the Backend selected for h
+// instead of the package-wide DefaultHandle. Passing a Handle built on
+// top of a fake exec.Interface makes set creation testable without a
+// real ipset binary.
+func NewWithHandle(h *Handle, name string, hashtype string, p *Params) (*IPSet, error) {
+	if err := h.CheckVersion(); err != nil {
+		return nil, err
 	}
 
-	if p.HashFamily == "" {
-		p.HashFamily = "inet"
+	setType := SetType(hashtype)
+	if err := setType.validate(p); err != nil {
+		return nil, err
 	}
 
-	// Check if hashtype is a type of hash
-	if !strings.HasPrefix(hashtype, "hash:") {
-		return nil, fmt.Errorf("not a hash type: %s", hashtype)
+	s := IPSet{
+		Name:       name,
+		HashType:   hashtype,
+		HashFamily: p.HashFamily,
+		HashSize:   p.HashSize,
+		MaxElem:    p.MaxElem,
+		Timeout:    p.Timeout,
+		Range:      p.Range,
+		Size:       p.Size,
+		backend:    backendForHandle(h),
 	}
-
-	s := IPSet{name, hashtype, p.HashFamily, p.HashSize, p.MaxElem, p.Timeout}
 	err := s.createHashSet(name, p.Exist)
 	if err != nil {
 		return nil, err
@@ -130,7 +137,7 @@ func New(name string, hashtype string, p *Params) (*IPSet, error) {
 
 // Names is used to show names of all lists
 func Names() ([]string, error) {
-	out, err := exec.Command(ipsetPath, "-n", "list").CombinedOutput()
+	out, err := defaultCLI().h.run("-n", "list")
 	if err != nil {
 		return []string{}, fmt.Errorf("error listing names: %v (%s)", err, out)
 	}
@@ -139,86 +146,110 @@ func Names() ([]string, error) {
 
 // List is used to show the contents of a set
 func List(listName string) ([]string, error) {
-	out, err := exec.Command(ipsetPath, "list", listName).CombinedOutput()
-	if err != nil {
-		return []string{}, fmt.Errorf("error listing set %s: %v (%s)", listName, err, out)
-	}
-	r := regexp.MustCompile("(?m)^(.*\n)*Members:\n")
-	list := r.ReplaceAllString(string(out[:]), "")
-	return strings.Split(list, "\n"), nil
+	return defaultCLI().List(listName)
 }
 
 // Destroy is used to destroy the set.
 func Destroy(listName string) error {
-	out, err := exec.Command(ipsetPath, "destroy", listName).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error destroying set %s: %v (%s)", listName, err, out)
-	}
-	return nil
+	return defaultCLI().Destroy(listName)
 }
 
 // Refresh is used to to overwrite the set with the specified entries.
 // The ipset is updated on the fly by hot swapping it with a temporary set.
 func (s *IPSet) Refresh(entries []string) error {
-	tempName := s.Name + "-temp"
-	err := s.createHashSet(tempName, true)
-	if err != nil {
-		return err
+	typed := make([]Entry, len(entries))
+	for i, entry := range entries {
+		typed[i] = RawEntry(entry)
 	}
-	for _, entry := range entries {
-		out, err := exec.Command(ipsetPath, "add", tempName, entry, "-exist").CombinedOutput()
-		if err != nil {
-			log.Errorf("error adding entry %s to set %s: %v (%s)", entry, tempName, err, out)
-		}
-	}
-	err = Swap(tempName, s.Name)
-	if err != nil {
+	if err := s.backend.Refresh(s, typed); err != nil {
 		return err
 	}
-	err = destroyIPSet(tempName)
-	if err != nil {
-		return err
+	s.expectedMu.Lock()
+	s.expected = make(map[string]expectedEntry, len(typed))
+	s.expectedMu.Unlock()
+	for _, entry := range typed {
+		s.rememberExpected(entry, 0)
 	}
 	return nil
 }
 
 // Test is used to check whether the specified entry is in the set or not.
 func Test(listName, entry string) (bool, error) {
-	out, err := exec.Command(ipsetPath, "test", listName, entry).CombinedOutput()
-	if err == nil {
-		reg, e := regexp.Compile("NOT")
-		if e == nil && reg.MatchString(string(out)) {
-			return false, nil
-		} else if e == nil {
-			return true, nil
-		} else {
-			return false, fmt.Errorf("error testing entry %s: %v", entry, e)
-		}
-	} else {
-		return false, fmt.Errorf("error testing entry %s: %v (%s)", entry, err, out)
-	}
+	return defaultCLI().Test(listName, RawEntry(entry))
 }
-func (s *IPSet) Test(entry string) (bool, error) {
-	return Test(s.Name, entry)
+
+// Test is used to check whether the specified entry is in the set or not.
+// entry may be a typed Entry (EntryIP, EntryNet, ...) or a RawEntry for
+// compatibility with the original string-based API.
+func (s *IPSet) Test(entry Entry) (bool, error) {
+	return s.backend.Test(s.Name, entry)
 }
 
 // Add is used to add the specified entry to the set.
 // A timeout of 0 means that the entry will be stored permanently in the set.
 func Add(listName, entry string, timeout int) error {
-	out, err := exec.Command(ipsetPath, "add", listName, entry, "timeout", strconv.Itoa(timeout), "-exist").CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error adding entry %s: %v (%s)", entry, err, out)
+	return defaultCLI().Add(listName, RawEntry(entry), timeout)
+}
+
+// Add is used to add the specified entry to the set.
+// A timeout of 0 means that the entry will be stored permanently in the set.
+// entry may be a typed Entry (EntryIP, EntryNet, ...) or a RawEntry for
+// compatibility with the original string-based API.
+func (s *IPSet) Add(entry Entry, timeout int) error {
+	if err := s.backend.Add(s.Name, entry, timeout); err != nil {
+		return err
 	}
+	s.rememberExpected(entry, timeout)
 	return nil
 }
-func (s *IPSet) Add(entry string, timeout int) error {
-	return Add(s.Name, entry, timeout)
+
+// entryValue returns the core value token of entry's ipsetArgs, e.g.
+// "192.0.2.1" or "192.0.2.0/24" or "192.0.2.1,tcp:443" — the entry
+// without CLI options like nomatch/comment/skbmark. This is the
+// identity "ipset list" reports a member under, and is what
+// resyncAfterDelete must compare against; matching on the full
+// ipsetArgs() (options included) would make every entry with an option,
+// or a timeout ipset itself appends when listing, look "missing".
+func entryValue(entry Entry) string {
+	args := entry.ipsetArgs()
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// memberValue extracts the same core value from one "ipset list"
+// member line, which may carry "timeout <secs>", "comment "..."",
+// "nomatch" and other extension output after the value.
+func memberValue(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func (s *IPSet) rememberExpected(entry Entry, timeout int) {
+	s.expectedMu.Lock()
+	defer s.expectedMu.Unlock()
+	if s.expected == nil {
+		s.expected = make(map[string]expectedEntry)
+	}
+	s.expected[entryValue(entry)] = expectedEntry{entry: entry, timeout: timeout}
+}
+
+func (s *IPSet) forgetExpected(entry Entry) {
+	s.expectedMu.Lock()
+	defer s.expectedMu.Unlock()
+	delete(s.expected, entryValue(entry))
 }
 
 // AddOption is used to add the specified entry to the set.
 // A timeout of 0 means that the entry will be stored permanently in the set.
+// AddOption always goes through the CLI, since options such as "nomatch"
+// are not yet implemented by the netlink backend.
 func (s *IPSet) AddOption(entry string, option string, timeout int) error {
-	out, err := exec.Command(ipsetPath, "add", s.Name, entry, option, "timeout", strconv.Itoa(timeout), "-exist").CombinedOutput()
+	out, err := defaultCLI().h.run("add", s.Name, entry, option, "timeout", fmt.Sprint(timeout), "-exist")
 	if err != nil {
 		return fmt.Errorf("error adding entry %s with option %s : %v (%s)", entry, option, err, out)
 	}
@@ -227,38 +258,82 @@ func (s *IPSet) AddOption(entry string, option string, timeout int) error {
 
 // Del is used to delete the specified entry from the set.
 func Del(listName, entry string) error {
-	out, err := exec.Command(ipsetPath, "del", listName, entry, "-exist").CombinedOutput()
+	return defaultCLI().Del(listName, RawEntry(entry))
+}
+
+// Del is used to delete the specified entry from the set.
+// entry may be a typed Entry (EntryIP, EntryNet, ...) or a RawEntry for
+// compatibility with the original string-based API.
+//
+// On Linux 4.2-4.10, ipset has a known bug where deleting one member of
+// a set can silently drop unrelated members too. When the running
+// kernel falls in that range (or WithResyncOnDelete(true) forces it),
+// Del re-lists the set afterwards and re-adds anything that was
+// previously Add-ed but has unexpectedly disappeared. This only covers
+// the per-entry delete path; Refresh sidesteps the bug entirely by
+// hot-swapping into a freshly built set rather than deleting from the
+// live one.
+func (s *IPSet) Del(entry Entry) error {
+	if err := s.backend.Del(s.Name, entry); err != nil {
+		return err
+	}
+	s.forgetExpected(entry)
+	if !handleFor(s.backend).resyncOnDeleteEnabled() {
+		return nil
+	}
+	return s.resyncAfterDelete()
+}
+
+// resyncAfterDelete re-lists the set and re-adds, with their original
+// timeout, any entry still in s.expected that the kernel bug described
+// on Del silently dropped.
+func (s *IPSet) resyncAfterDelete() error {
+	present, err := s.backend.List(s.Name)
 	if err != nil {
-		return fmt.Errorf("error deleting entry %s: %v (%s)", entry, err, out)
+		return err
+	}
+	presentValues := make(map[string]struct{}, len(present))
+	for _, line := range present {
+		if v := memberValue(line); v != "" {
+			presentValues[v] = struct{}{}
+		}
+	}
+
+	s.expectedMu.Lock()
+	var missing []expectedEntry
+	for value, ee := range s.expected {
+		if _, ok := presentValues[value]; !ok {
+			missing = append(missing, ee)
+		}
+	}
+	s.expectedMu.Unlock()
+
+	for _, ee := range missing {
+		if err := s.backend.Add(s.Name, ee.entry, ee.timeout); err != nil {
+			return err
+		}
 	}
 	return nil
 }
-func (s *IPSet) Del(entry string) error {
-	return Del(s.Name, entry)
-}
 
 // Flush is used to flush all entries in the set.
 func (s *IPSet) Flush() error {
-	out, err := exec.Command(ipsetPath, "flush", s.Name).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error flushing set %s: %v (%s)", s.Name, err, out)
-	}
-	return nil
+	return s.backend.Flush(s.Name)
 }
 
 // List is used to show the contents of a set
 func (s *IPSet) List() ([]string, error) {
-	return List(s.Name)
+	return s.backend.List(s.Name)
 }
 
 // Destroy is used to destroy the set.
 func (s *IPSet) Destroy() error {
-	return Destroy(s.Name)
+	return s.backend.Destroy(s.Name)
 }
 
 // DestroyAll is used to destroy the set.
 func DestroyAll() error {
-	out, err := exec.Command(ipsetPath, "destroy").CombinedOutput()
+	out, err := defaultCLI().h.run("destroy")
 	if err != nil {
 		return fmt.Errorf("error destroying set %s (%s)", err, out)
 	}
@@ -267,61 +342,5 @@ func DestroyAll() error {
 
 // Swap is used to hot swap two sets on-the-fly. Use with names of existing sets of the same type.
 func Swap(from, to string) error {
-	out, err := exec.Command(ipsetPath, "swap", from, to).Output()
-	if err != nil {
-		return fmt.Errorf("error swapping ipset %s to %s: %v (%s)", from, to, err, out)
-	}
-	return nil
-}
-
-func destroyIPSet(name string) error {
-	out, err := exec.Command(ipsetPath, "destroy", name).Output()
-	if err != nil {
-		return fmt.Errorf("error destroying ipset %s: %v (%s)", name, err, out)
-	}
-	return nil
-}
-
-func destroyAll() error {
-	out, err := exec.Command(ipsetPath, "destroy").Output()
-	if err != nil {
-		return fmt.Errorf("error destroying all ipsetz %s (%s)", err, out)
-	}
-	return nil
-}
-
-func getIpsetSupportedVersion() (bool, error) {
-	minVersion, err := semver.NewVersion(minIpsetVersion)
-	if err != nil {
-		return false, err
-	}
-	// Returns "vX.Y".
-	vstring, err := getIpsetVersionString()
-	if err != nil {
-		return false, err
-	}
-	// Make a dotted-tri format version string
-	vstring = vstring + ".0"
-	// Make a semver of the part after the v in "vX.X.X".
-	version, err := semver.NewVersion(vstring[1:])
-	if err != nil {
-		return false, err
-	}
-	if version.LessThan(*minVersion) {
-		return false, nil
-	}
-	return true, nil
-}
-
-func getIpsetVersionString() (string, error) {
-	bytes, err := exec.Command(ipsetPath, "--version").CombinedOutput()
-	if err != nil {
-		return "", err
-	}
-	versionMatcher := regexp.MustCompile("v[0-9]+\\.[0-9]+")
-	match := versionMatcher.FindStringSubmatch(string(bytes))
-	if match == nil {
-		return "", fmt.Errorf("no ipset version found in string: %s", bytes)
-	}
-	return match[0], nil
+	return defaultCLI().Swap(from, to)
 }
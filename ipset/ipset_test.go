@@ -0,0 +1,93 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipset
+
+import (
+	"testing"
+
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+// TestIPSetDelResyncsDroppedMembers simulates the 4.2-4.10 kernel bug:
+// deleting "10.0.0.2" from a three-member set unexpectedly also drops
+// "10.0.0.3". Del should notice via the post-delete List and re-add it
+// with its original timeout. "10.0.0.1" survives and is listed with a
+// "timeout" suffix, which must not make it look missing too.
+func TestIPSetDelResyncsDroppedMembers(t *testing.T) {
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(""), nil },                                 // del 10.0.0.2
+			func() ([]byte, error) { return []byte("4.4.0-21-generic\n"), nil },               // uname -r
+			func() ([]byte, error) { return []byte("Members:\n10.0.0.1 timeout 300\n"), nil }, // list, missing 10.0.0.3
+			func() ([]byte, error) { return []byte(""), nil },                                 // re-add 10.0.0.3
+		},
+	}
+	fexec := &fakeexec.FakeExec{
+		LookPathFunc: func(string) (string, error) { return "/usr/sbin/ipset", nil },
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	h := NewHandle("", fexec)
+	s := &IPSet{Name: "blocklist", HashType: string(HashIP), backend: cliBackend{h: h}}
+	s.rememberExpected(RawEntry("10.0.0.1"), 500)
+	s.rememberExpected(RawEntry("10.0.0.3"), 500)
+
+	if err := s.Del(RawEntry("10.0.0.2")); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if fcmd.CombinedOutputCalls != 4 {
+		t.Fatalf("expected del+list+re-add to run (plus the uname check), got %d calls", fcmd.CombinedOutputCalls)
+	}
+	readd := fcmd.CombinedOutputLog[3]
+	want := []string{"/usr/sbin/ipset", "add", "blocklist", "10.0.0.3", "timeout", "500", "-exist"}
+	if len(readd) != len(want) || readd[3] != want[3] || readd[5] != want[5] {
+		t.Fatalf("got re-add args %v, want something matching %v", readd, want)
+	}
+}
+
+// TestIPSetDelSkipsResyncOnUnaffectedKernel verifies Del does nothing
+// beyond the delete itself when resync-on-delete isn't needed.
+func TestIPSetDelSkipsResyncOnUnaffectedKernel(t *testing.T) {
+	fcmd := fakeexec.FakeCmd{
+		CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(""), nil },                // del
+			func() ([]byte, error) { return []byte("6.1.0-generic\n"), nil }, // uname -r
+		},
+	}
+	fexec := &fakeexec.FakeExec{
+		LookPathFunc: func(string) (string, error) { return "/usr/sbin/ipset", nil },
+		CommandScript: []fakeexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return fakeexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	h := NewHandle("", fexec)
+	s := &IPSet{Name: "blocklist", HashType: string(HashIP), backend: cliBackend{h: h}}
+	s.rememberExpected(RawEntry("10.0.0.1"), 0)
+
+	if err := s.Del(RawEntry("10.0.0.1")); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if fcmd.CombinedOutputCalls != 2 {
+		t.Fatalf("expected only the uname check and the delete, got %d calls", fcmd.CombinedOutputCalls)
+	}
+}
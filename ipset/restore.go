@@ -0,0 +1,173 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipset
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// restoreScript builds the line-oriented command format understood by
+// "ipset restore", one command per line.
+type restoreScript struct {
+	buf bytes.Buffer
+}
+
+func (r *restoreScript) create(name, hashType string, p *Params) {
+	fmt.Fprintf(&r.buf, "create %s %s", name, hashType)
+	switch SetType(hashType) {
+	case BitmapIP, BitmapPort, BitmapIPMAC:
+		fmt.Fprintf(&r.buf, " range %s", p.Range)
+	case ListSet:
+		fmt.Fprintf(&r.buf, " size %d", p.Size)
+	default:
+		fmt.Fprintf(&r.buf, " family %s hashsize %d maxelem %d", p.HashFamily, p.HashSize, p.MaxElem)
+	}
+	fmt.Fprintf(&r.buf, " timeout %d", p.Timeout)
+	if p.Exist {
+		r.buf.WriteString(" -exist")
+	}
+	r.buf.WriteByte('\n')
+}
+
+func (r *restoreScript) flush(name string) {
+	fmt.Fprintf(&r.buf, "flush %s\n", name)
+}
+
+func (r *restoreScript) add(name string, entry Entry, timeout int) {
+	fmt.Fprintf(&r.buf, "add %s", name)
+	for _, arg := range entry.ipsetArgs() {
+		fmt.Fprintf(&r.buf, " %s", restoreToken(arg))
+	}
+	if timeout > 0 {
+		fmt.Fprintf(&r.buf, " timeout %d", timeout)
+	}
+	r.buf.WriteString(" -exist\n")
+}
+
+// restoreToken quotes arg if it contains whitespace, the way a comment
+// ("comment" extension value) needs to be on an "ipset restore" line so
+// it reads as one token instead of several. Entry.ipsetArgs() returns
+// its tokens unquoted, since cliBackend passes them to exec.Command
+// verbatim with no shell to do that quoting for it; the restore script
+// format is the one place that needs it.
+func restoreToken(arg string) string {
+	if strings.ContainsAny(arg, " \t") {
+		return fmt.Sprintf("%q", arg)
+	}
+	return arg
+}
+
+func (r *restoreScript) swap(from, to string) {
+	fmt.Fprintf(&r.buf, "swap %s %s\n", from, to)
+}
+
+func (r *restoreScript) destroy(name string) {
+	fmt.Fprintf(&r.buf, "destroy %s\n", name)
+}
+
+func (r *restoreScript) Bytes() []byte {
+	return r.buf.Bytes()
+}
+
+// runRestore pipes an ipset-restore script into a single "ipset restore"
+// process via stdin.
+func (h *Handle) runRestore(script []byte) error {
+	cmd, err := h.command("restore", "-exist")
+	if err != nil {
+		return err
+	}
+	cmd.SetStdin(bytes.NewReader(script))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error restoring ipset: %v (%s)", err, out)
+	}
+	return nil
+}
+
+// handleFor returns the Handle backing b, falling back to
+// DefaultHandle() for backends (such as a bare netlinkBackend) that
+// don't carry one; Restore/Save always go through the CLI regardless
+// of which Backend a set otherwise dispatches through.
+func handleFor(b Backend) *Handle {
+	switch backend := b.(type) {
+	case cliBackend:
+		return backend.h
+	case fallbackBackend:
+		return backend.cli.h
+	}
+	return DefaultHandle()
+}
+
+// Restore (re)creates the set and loads entries into it in a single
+// "ipset restore" process, instead of forking "ipset add" once per
+// entry. Unlike Refresh it does not hot-swap: the set is flushed and
+// repopulated in place.
+func (s *IPSet) Restore(entries []string) error {
+	var script restoreScript
+	script.create(s.Name, s.HashType, &Params{
+		HashFamily: s.HashFamily,
+		HashSize:   s.HashSize,
+		MaxElem:    s.MaxElem,
+		Timeout:    s.Timeout,
+		Range:      s.Range,
+		Size:       s.Size,
+		Exist:      true,
+	})
+	script.flush(s.Name)
+	for _, entry := range entries {
+		script.add(s.Name, RawEntry(entry), 0)
+	}
+	return handleFor(s.backend).runRestore(script.Bytes())
+}
+
+// RestoreAll (re)creates and flushes a batch of sets in a single "ipset
+// restore" process, instead of one "ipset create"/"ipset flush" pair
+// per set. It is meant for bulk (re)initialization of many sets at
+// startup; populate each set's entries afterwards with Restore or
+// Refresh.
+func RestoreAll(sets []*IPSet) error {
+	var script restoreScript
+	h := DefaultHandle()
+	for _, s := range sets {
+		script.create(s.Name, s.HashType, &Params{
+			HashFamily: s.HashFamily,
+			HashSize:   s.HashSize,
+			MaxElem:    s.MaxElem,
+			Timeout:    s.Timeout,
+			Range:      s.Range,
+			Size:       s.Size,
+			Exist:      true,
+		})
+		script.flush(s.Name)
+		h = handleFor(s.backend)
+	}
+	return h.runRestore(script.Bytes())
+}
+
+// Save returns the "ipset save" output for the given set names, or for
+// every set on the system if none are given. The result is in the same
+// line-oriented format that "ipset restore" reads; Restore and
+// RestoreAll take entries and sets, not this output.
+func Save(setNames ...string) ([]byte, error) {
+	out, err := DefaultHandle().run(append([]string{"save"}, setNames...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error saving ipset state: %v (%s)", err, out)
+	}
+	return out, nil
+}
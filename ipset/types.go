@@ -0,0 +1,218 @@
+/*
+Copyright 2015 Jan Broer All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipset
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetType identifies the kind of set being created, mirroring the
+// "settype" argument to "ipset create".
+type SetType string
+
+const (
+	HashIP         SetType = "hash:ip"
+	HashNet        SetType = "hash:net"
+	HashIPPort     SetType = "hash:ip,port"
+	HashNetPort    SetType = "hash:net,port"
+	HashNetPortNet SetType = "hash:net,port,net"
+	HashMAC        SetType = "hash:mac"
+	BitmapIP       SetType = "bitmap:ip"
+	BitmapPort     SetType = "bitmap:port"
+	BitmapIPMAC    SetType = "bitmap:ip,mac"
+	ListSet        SetType = "list:set"
+)
+
+// validate checks that p carries the parameters t requires and fills
+// in type-appropriate defaults, the same way New used to do for
+// hash:ip alone.
+func (t SetType) validate(p *Params) error {
+	switch t {
+	case HashIP, HashNet, HashIPPort, HashNetPort, HashNetPortNet, HashMAC:
+		if p.HashSize == 0 {
+			p.HashSize = 1024
+		}
+		if p.MaxElem == 0 {
+			p.MaxElem = 65536
+		}
+		if p.HashFamily == "" {
+			p.HashFamily = "inet"
+		}
+	case BitmapIP, BitmapPort, BitmapIPMAC:
+		if p.Range == "" {
+			return fmt.Errorf("set type %s requires Params.Range", t)
+		}
+	case ListSet:
+		if p.Size == 0 {
+			p.Size = 8
+		}
+	default:
+		return fmt.Errorf("unsupported set type: %s", t)
+	}
+	return nil
+}
+
+// Entry is a single member of a set, in the representation required by
+// the set's type. Use the EntryXxx constructors to build one, or wrap a
+// raw CLI argument with RawEntry for compatibility with the original
+// string-based API.
+type Entry interface {
+	ipsetArgs() []string
+}
+
+// RawEntry passes its value to ipset verbatim. It exists so code
+// written against the original string-based Add/Del/Test keeps
+// working after those methods moved to Entry.
+type RawEntry string
+
+func (e RawEntry) ipsetArgs() []string { return []string{string(e)} }
+
+type entryOptions struct {
+	nomatch  bool
+	comment  string
+	skbMark  string
+	skbPrio  string
+	skbQueue string
+}
+
+// EntryOption configures the CLI extensions ipset accepts on an add/del,
+// such as "nomatch" or "comment".
+type EntryOption func(*entryOptions)
+
+// WithNoMatch marks the entry as an exception when the set type
+// supports nomatch (e.g. hash:net).
+func WithNoMatch() EntryOption { return func(o *entryOptions) { o.nomatch = true } }
+
+// WithComment attaches a comment to the entry; the set must have been
+// created with the "comment" extension.
+func WithComment(comment string) EntryOption {
+	return func(o *entryOptions) { o.comment = comment }
+}
+
+// WithSKBMark sets the skbmark extension value, e.g. "0x10/0xff".
+func WithSKBMark(mark string) EntryOption { return func(o *entryOptions) { o.skbMark = mark } }
+
+// WithSKBPrio sets the skbprio extension value, e.g. "1:10".
+func WithSKBPrio(prio string) EntryOption { return func(o *entryOptions) { o.skbPrio = prio } }
+
+// WithSKBQueue sets the skbqueue extension value.
+func WithSKBQueue(queue string) EntryOption { return func(o *entryOptions) { o.skbQueue = queue } }
+
+func newEntryOptions(opts []EntryOption) entryOptions {
+	var o entryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o entryOptions) args() []string {
+	var args []string
+	if o.nomatch {
+		args = append(args, "nomatch")
+	}
+	if o.comment != "" {
+		args = append(args, "comment", o.comment)
+	}
+	if o.skbMark != "" {
+		args = append(args, "skbmark", o.skbMark)
+	}
+	if o.skbPrio != "" {
+		args = append(args, "skbprio", o.skbPrio)
+	}
+	if o.skbQueue != "" {
+		args = append(args, "skbqueue", o.skbQueue)
+	}
+	return args
+}
+
+type entryIP struct {
+	ip   net.IP
+	opts entryOptions
+}
+
+// EntryIP builds an entry for hash:ip and bitmap:ip sets.
+func EntryIP(ip net.IP, opts ...EntryOption) Entry {
+	return entryIP{ip: ip, opts: newEntryOptions(opts)}
+}
+
+func (e entryIP) ipsetArgs() []string {
+	return append([]string{e.ip.String()}, e.opts.args()...)
+}
+
+type entryNet struct {
+	ipNet *net.IPNet
+	opts  entryOptions
+}
+
+// EntryNet builds an entry for hash:net sets, e.g. "192.0.2.0/24".
+func EntryNet(ipNet *net.IPNet, opts ...EntryOption) Entry {
+	return entryNet{ipNet: ipNet, opts: newEntryOptions(opts)}
+}
+
+func (e entryNet) ipsetArgs() []string {
+	return append([]string{e.ipNet.String()}, e.opts.args()...)
+}
+
+type entryIPPort struct {
+	ip    net.IP
+	proto string
+	port  int
+	opts  entryOptions
+}
+
+// EntryIPPort builds an entry for hash:ip,port and hash:net,port sets,
+// e.g. "192.0.2.1,tcp:443". proto is the protocol keyword ipset expects
+// ("tcp", "udp", ...).
+func EntryIPPort(ip net.IP, proto string, port int, opts ...EntryOption) Entry {
+	return entryIPPort{ip: ip, proto: proto, port: port, opts: newEntryOptions(opts)}
+}
+
+func (e entryIPPort) ipsetArgs() []string {
+	value := fmt.Sprintf("%s,%s:%d", e.ip.String(), e.proto, e.port)
+	return append([]string{value}, e.opts.args()...)
+}
+
+type entryMAC struct {
+	mac  net.HardwareAddr
+	opts entryOptions
+}
+
+// EntryMAC builds an entry for hash:mac and bitmap:ip,mac sets.
+func EntryMAC(mac net.HardwareAddr, opts ...EntryOption) Entry {
+	return entryMAC{mac: mac, opts: newEntryOptions(opts)}
+}
+
+func (e entryMAC) ipsetArgs() []string {
+	return append([]string{e.mac.String()}, e.opts.args()...)
+}
+
+type entrySetRef struct {
+	setName string
+	opts    entryOptions
+}
+
+// EntrySetRef builds an entry referencing another set by name, for
+// list:set sets.
+func EntrySetRef(setName string, opts ...EntryOption) Entry {
+	return entrySetRef{setName: setName, opts: newEntryOptions(opts)}
+}
+
+func (e entrySetRef) ipsetArgs() []string {
+	return append([]string{e.setName}, e.opts.args()...)
+}